@@ -0,0 +1,131 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Identity describes who is on the other end of a connection, as decided by
+// an Authenticator. It is attached to the Client and surfaced to the Hub on
+// register so downstream code can trust it instead of whatever the payload
+// itself claims.
+// Identityは、Authenticatorが判定した接続相手の身元を表します。Clientに
+// 紐づけられ、registerでHubにも伝わるので、ペイロードの自己申告を信用する
+// 代わりに、以降の処理はこのIdentityを信頼できます。
+type Identity struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Roles []string  `json:"roles,omitempty"`
+}
+
+// hasRole reports whether role is among the identity's roles.
+func (i Identity) hasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator decides whether an upgrade request is allowed, and which
+// Identity it is allowed as. serveWs calls Authenticate before upgrading the
+// connection and rejects the request with a plain 401 on error.
+// Authenticatorは、アップグレードリクエストを許可するかどうか、許可する場合
+// はどのIdentityとしてかを判定します。serveWsはUpgradeの前にAuthenticateを
+// 呼び出し、エラーであれば素の401でリクエストを拒否します。
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AllowAllAuthenticator accepts every request and assigns it a fresh,
+// nameless Identity. It exists so a server that hasn't wired in real
+// authentication yet still has an Authenticator to pass to serveWs.
+// AllowAllAuthenticatorは、すべてのリクエストを許可し、無名の新規Identityを
+// 割り当てます。本物の認証をまだ組み込んでいないサーバーでも、serveWsに
+// 渡すAuthenticatorを用意できるようにするためのものです。
+type AllowAllAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (AllowAllAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	return Identity{ID: uuid.New()}, nil
+}
+
+// BearerTokenAuthenticator accepts a request whose Authorization header
+// carries "Bearer <token>" for a token Lookup recognizes.
+// BearerTokenAuthenticatorは、AuthorizationヘッダーがLookupの認識する
+// トークンで"Bearer <token>"になっているリクエストを許可します。
+type BearerTokenAuthenticator struct {
+	// Lookup resolves a bearer token to the Identity it represents. It
+	// must return an error for unknown or invalid tokens.
+	Lookup func(token string) (Identity, error)
+}
+
+// Authenticate implements Authenticator.
+func (a BearerTokenAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return Identity{}, errors.New("auth: missing bearer token")
+	}
+	if a.Lookup == nil {
+		return Identity{}, errors.New("auth: no token lookup configured")
+	}
+	return a.Lookup(strings.TrimPrefix(header, prefix))
+}
+
+// SignedCookieAuthenticator accepts a request carrying a session cookie of
+// the form "<base64 identity json>.<hex hmac-sha256>", signed with Secret.
+// It is a minimal stand-in for whatever session store the caller actually
+// uses; Secret should be at least 32 random bytes.
+// SignedCookieAuthenticatorは、"<base64化したidentityのJSON>.<16進hmac-sha256>"
+// という形のセッションCookieをSecretで検証して許可します。実際に使う
+// セッションストアの代わりとなる最小限の実装で、Secretは最低32バイトの
+// ランダム値であるべきです。
+type SignedCookieAuthenticator struct {
+	CookieName string
+	Secret     []byte
+}
+
+// Authenticate implements Authenticator.
+func (a SignedCookieAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	cookie, err := r.Cookie(a.CookieName)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	payload, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return Identity{}, errors.New("auth: malformed session cookie")
+	}
+
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(payload))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return Identity{}, errors.New("auth: invalid session signature")
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(payload)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(raw, &identity); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
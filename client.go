@@ -6,51 +6,147 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	// 信号を受けてから、読み込みきれるまでの制限時間
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
-
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// Control frame ops recognized by readPump for topic subscription.
+// readPumpが、トピック購読のために認識する制御フレームのop一覧。
+const (
+	opSubscribe   = "sub"
+	opUnsubscribe = "unsub"
+	opPublish     = "pub"
+)
+
+// controlFrame is the small JSON shape a client sends to subscribe to,
+// unsubscribe from, or publish into a topic, e.g.
+// {"op":"sub","topic":"room42"} or
+// {"op":"pub","topic":"room42","data":"aGVsbG8="}. Data is kept as raw JSON
+// (rather than []byte, which encoding/json would silently require to be
+// base64 on the wire) so a malformed pub frame can be detected and rejected
+// by op instead of failing the whole controlFrame unmarshal and quietly
+// falling through to the Envelope parsing path below.
+// controlFrameは、クライアントがトピックを購読・購読解除・発行するために送る
+// 小さなJSONの形です。Data はそのまま生のJSONとして保持します（[]byteに
+// すると encoding/json がワイヤー上でbase64であることを暗黙に要求する
+// ため）。こうすることで、pubフレームの不正なdataをop単位で検知・拒否でき、
+// controlFrame全体のunmarshalが失敗して下のEnvelope解析に黙って落ちる、
+// という事態を避けられます。
+type controlFrame struct {
+	Op    string          `json:"op"`
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// decodePublishData decodes a pub frame's "data" field, which must be a
+// JSON string holding base64-encoded bytes — the same wire representation
+// encoding/json gives Envelope.Payload ([]byte marshals to a base64
+// string). Returns an error for anything else instead of silently
+// producing an empty payload.
+func decodePublishData(raw json.RawMessage) ([]byte, error) {
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, fmt.Errorf("pub data must be a base64-encoded JSON string: %w", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("pub data is not valid base64: %w", err)
+	}
+	return payload, nil
 }
 
 // Client is a middleman between the websocket connection and the hub.
 // クライアントは、WebSocket接続とハブの間の仲介者です。
 type Client struct {
+	// id uniquely identifies this connection so the hub can route direct
+	// messages to it. Assigned by serveWs and handed back to the client as
+	// the first envelope frame.
+	// idは、ハブが宛先指定のメッセージをこの接続に配送できるように割り振る
+	// 識別子です。serveWsで割り当てられ、最初のEnvelopeフレームとして
+	// クライアントに伝えられます。
+	id uuid.UUID
+
+	// identity is who Authenticate said this connection belongs to. Unlike
+	// id, it's trusted to carry a display name and roles.
+	// identityは、Authenticateがこの接続を誰のものと判定したかです。idと
+	// 違い、表示名やロールまで信頼して保持しています。
+	identity Identity
+
+	// Topics this client is currently subscribed to, mirrored from the
+	// hub's reverse index so unregister can unwind them without a lookup.
+	// readPump (this connection's own goroutine) writes it on sub/unsub
+	// frames, while Hub.dropClient reads it from the hub's goroutine on a
+	// slow-consumer drop, so topicsMu guards every access.
+	// このクライアントが現在購読しているトピックの集合。ハブの逆引き
+	// インデックスと対になっており、unregister時に検索なしで巻き戻せる。
+	// readPump（この接続自身のゴルーチン）がsub/unsubフレームで書き込み、
+	// Hub.dropClientは低速コンシューマの切断時にハブのゴルーチンから
+	// 読み取るため、すべてのアクセスをtopicsMuで保護しています。
+	topicsMu sync.Mutex
+	topics   map[string]struct{}
+
 	// どのハブを使用しているかの情報を持っていたほうがいい
 	hub *Hub
 
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
+	// Buffered channel of outbound envelopes.
 	// outbound: 〈飛行機・船が〉外国行きの. 2. 〈交通機関など〉市外に向かう.
 	// このチャンネルにデータぶっこんだら、クライアントに文字が発信される
-	send chan []byte
+	send chan Envelope
+
+	// maxMessageSize, writeWait, pongWait and pingPeriod mirror the
+	// ServerConfig this client was created with, so the pumps no longer
+	// depend on package-level constants.
+	// maxMessageSize、writeWait、pongWait、pingPeriodは、このクライアントが
+	// 生成されたときのServerConfigをそのまま写したものです。これにより、
+	// pumpはパッケージレベルの定数に依存しなくなります。
+	maxMessageSize int64
+	writeWait      time.Duration
+	pongWait       time.Duration
+	pingPeriod     time.Duration
+}
+
+// addTopic records that c has subscribed to topic.
+func (c *Client) addTopic(topic string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	c.topics[topic] = struct{}{}
+}
+
+// removeTopic records that c has unsubscribed from topic.
+func (c *Client) removeTopic(topic string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	delete(c.topics, topic)
+}
+
+// topicSnapshot returns the topics c is currently subscribed to. Called by
+// Hub.dropClient from the hub's own goroutine, so it copies rather than
+// returning c.topics itself.
+func (c *Client) topicSnapshot() []string {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -69,14 +165,14 @@ func (c *Client) readPump() {
 		c.conn.Close()
 	}()
 	// 読み込みサイズ上限
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.maxMessageSize)
 	// 読み込み時間制限
 	// SetReadDeadlineは、基盤となるネットワーク接続の読み取り期限を設定します。 読み取りがタイムアウトした後、WebSocket接続状態が破損し、それ以降のすべての読み取りでエラーが返されます。 tのゼロ値は、読み取りがタイムアウトしないことを意味します。
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
 	// Pingもらったら、Pongを返す
 	// SetPongHandlerは、ピアから受信したpongメッセージのハンドラーを設定します。 hのappData引数は、PONGメッセージアプリケーションデータです。 デフォルトのpongハンドラーは何もしません。
 	// ハンドラー関数は、NextReader、ReadMessage、およびメッセージリーダーのReadメソッドから呼び出されます。 上記の制御メッセージのセクションで説明されているように、アプリケーションは接続を読み取ってpongメッセージを処理する必要があります。
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.pongWait)); return nil })
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -85,10 +181,47 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		// データを加工して、全員に発信
-		// ある一人から受けたメッセージを、全員に向けるんだね！
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+
+		// まず、購読の出し入れ・発行を指示する小さな制御フレームかどうかを見る。
+		// {"op":"sub","topic":"room42"} / {"op":"unsub",...} / {"op":"pub",...}
+		var ctrl controlFrame
+		if err := json.Unmarshal(message, &ctrl); err == nil && ctrl.Op != "" {
+			switch ctrl.Op {
+			case opSubscribe:
+				// ハブに渡す前に記録しておき、その間にdropClientされても
+				// このトピックの購読が巻き戻されるようにする
+				c.addTopic(ctrl.Topic)
+				c.hub.subscribe <- subscription{client: c, topic: ctrl.Topic}
+			case opUnsubscribe:
+				c.hub.unsubscribe <- subscription{client: c, topic: ctrl.Topic}
+				c.removeTopic(ctrl.Topic)
+			case opPublish:
+				payload, err := decodePublishData(ctrl.Data)
+				if err != nil {
+					log.Printf("error: %v", err)
+					continue
+				}
+				c.hub.broadcast <- Envelope{From: c.id, Topic: ctrl.Topic, Payload: payload}
+			}
+			continue
+		}
+
+		// 制御フレームでなければ、外側にEnvelopeのJSONが被せてある前提で読む。
+		// それも失敗したら、生のペイロードとして扱い、宛先なし（＝ブロードキャスト）にする。
+		var envelope Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			envelope = Envelope{Payload: message}
+		}
+		envelope.From = c.id
+
+		// ある一人から受けたメッセージを、宛先があればその人だけに、
+		// なければ全員に向ける
+		if envelope.To == uuid.Nil {
+			c.hub.broadcast <- envelope
+		} else {
+			c.hub.direct <- envelope
+		}
 	}
 }
 
@@ -103,15 +236,15 @@ func (c *Client) readPump() {
 // アプリケーションは、このゴルーチンからのすべての書き込みを実行することにより、
 // 接続への書き込みが最大で1つであることを確認します。
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case envelope, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
 			if !ok {
 				// The hub closed the channel.
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -122,21 +255,32 @@ func (c *Client) writePump() {
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			// EnvelopeをJSONにシリアライズして書き出す
+			data, err := json.Marshal(envelope)
+			if err != nil {
+				log.Printf("error: %v", err)
+				continue
+			}
+			w.Write(data)
 
 			// Add queued chat messages to the current websocket message.
 			// まだメッセージ残っていたら、改行してメッセージをはき続ける
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				w.Write(newline)
-				w.Write(<-c.send)
+				next, err := json.Marshal(<-c.send)
+				if err != nil {
+					log.Printf("error: %v", err)
+					continue
+				}
+				w.Write(next)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -144,25 +288,110 @@ func (c *Client) writePump() {
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// serveWs handles websocket requests from the peer, using config to size
+// buffers, enable compression and restrict allowed origins. auth is
+// consulted before the upgrade; a failed Authenticate rejects the request
+// with a plain 401 instead of a mid-handshake close.
+func serveWs(hub *Hub, config ServerConfig, auth Authenticator, w http.ResponseWriter, r *http.Request) {
+	identity, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
 	// GETからWebSocketにアップグレード
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := config.upgrader().Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if config.EnableCompression {
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(config.CompressionLevel)
+	}
+
+	// 認証済みのidentityにidがなければ、この接続限りのidを割り振る
+	id := identity.ID
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
+
 	// 新規接続クライアントを、WebSocketチャネルに新規登録
 	// どのハブを経由しているかの情報を持っていたほうがいい
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{
+		id:             id,
+		identity:       identity,
+		hub:            hub,
+		conn:           conn,
+		send:           make(chan Envelope, config.SendBufferSize),
+		topics:         make(map[string]struct{}),
+		maxMessageSize: config.MaxMessageSize,
+		writeWait:      config.WriteWait,
+		pongWait:       config.PongWait,
+		pingPeriod:     config.PingPeriod,
+	}
+	// writePumpを先に起動し、送信チャネルを誰かが読み始めた状態にしておく
+	// （これをしないと、このあとのリプレイ分でチャネルが詰まりうる）
+	// pump: ポンプ
+	go client.writePump()
+
+	// 最初のフレームとして、割り当てたidをクライアント自身に伝える。
+	// これをFrom/Toに使えば、以降のメッセージを特定の相手宛に送れる。
+	// ハブに登録する前に積むので、他のメッセージがこれより先に届くことはない。
+	idPayload, err := json.Marshal(client.id)
+	if err != nil {
+		log.Println(err)
+	} else {
+		client.send <- Envelope{From: client.id, Payload: idPayload}
+	}
+
 	// hub.register <- client でも良さそう
 	// clientに紐づけたhubからもできるよ！ってことを誇張したかったのかな
 	client.hub.register <- client
 
+	// ?since=<seq> か Last-Event-ID ヘッダーがあれば、切断中に聞き逃した分を
+	// 通常配信が始まる前に再生する。?topic=room42 を繰り返し指定すれば、
+	// まだ購読フレームを送っていないトピックの履歴も合わせて再生できる
+	// （そうでなければ、宛先Topicなしの履歴しか返らない）。
+	if since, ok := sinceSeq(r); ok {
+		for _, envelope := range hub.replaySince(client, since, requestedTopics(r)) {
+			client.send <- envelope
+		}
+	}
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	// 新しいgoroutineですべての作業を行うことにより、呼び出し元が参照するメモリの収集を許可します。
-	// pump: ポンプ
-	go client.writePump()
 	go client.readPump()
 }
+
+// sinceSeq reads the resume point a reconnecting client asks to replay
+// from, preferring the ?since= query parameter and falling back to a
+// Last-Event-ID header. The second return value is false when neither is
+// present or parses as a uint64.
+func sinceSeq(r *http.Request) (uint64, bool) {
+	raw := r.URL.Query().Get("since")
+	if raw == "" {
+		raw = r.Header.Get("Last-Event-ID")
+	}
+	if raw == "" {
+		return 0, false
+	}
+	since, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return since, true
+}
+
+// requestedTopics collects the repeated ?topic= query parameters a
+// reconnecting client sends to say which topics it wants history replayed
+// for, alongside untargeted broadcasts.
+func requestedTopics(r *http.Request) map[string]struct{} {
+	values := r.URL.Query()["topic"]
+	topics := make(map[string]struct{}, len(values))
+	for _, topic := range values {
+		topics[topic] = struct{}{}
+	}
+	return topics
+}
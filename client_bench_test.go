@@ -0,0 +1,84 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// chatTranscript is a short, realistic run of chat lines. Benchmarks cycle
+// through it so compression sees the kind of repetition a real room would
+// produce, not random bytes.
+// chatTranscriptは、実際のチャットらしい短い発言の並びです。ベンチマークは
+// これを繰り返し使うことで、圧縮がランダムなバイト列ではなく、実際の
+// ルームで起こるような繰り返しを相手にするようにしています。
+var chatTranscript = []string{
+	"hey, anyone around?",
+	"yep, just got back from lunch",
+	"did you see the PR for the hub refactor?",
+	"not yet, link it here please",
+	"https://example.com/pulls/123",
+	"looking now, give me a sec",
+	"lgtm, just one nit about the comment wording",
+	"fixed, pushed a new commit",
+	"nice, merging",
+	"thanks for the quick review!",
+}
+
+// benchmarkThroughput spins up a real Hub and serveWs behind an
+// httptest.Server, dials it with a client-side websocket.Dialer configured
+// for the same compression setting, and round-trips chatTranscript lines
+// through it.
+func benchmarkThroughput(b *testing.B, enableCompression bool) {
+	config := DefaultServerConfig()
+	config.EnableCompression = enableCompression
+
+	hub := NewHub(config)
+	go hub.run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, config, AllowAllAuthenticator{}, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dialer := websocket.Dialer{EnableCompression: enableCompression}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 最初のフレームは、serveWsが送ってくる割り当てidなので読み捨てる
+	if _, _, err := conn.ReadMessage(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line := chatTranscript[i%len(chatTranscript)]
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			b.Fatal(err)
+		}
+		// hubがbroadcastし、自分の接続にも折り返ってくる
+		if _, _, err := conn.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(line)))
+	}
+}
+
+func BenchmarkThroughputUncompressed(b *testing.B) {
+	benchmarkThroughput(b, false)
+}
+
+func BenchmarkThroughputCompressed(b *testing.B) {
+	benchmarkThroughput(b, true)
+}
@@ -0,0 +1,167 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/flate"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Defaults mirrored from the original hard-coded constants, kept around so
+// DefaultServerConfig documents where these numbers came from.
+// 元々の定数値を、デフォルトとしてそのまま残したもの。
+// DefaultServerConfigがこの値の由来を示せるように名前を残している。
+const (
+	defaultReadBufferSize  = 1024
+	defaultWriteBufferSize = 1024
+	defaultSendBufferSize  = 256
+	defaultMaxMessageSize  = 512
+	defaultHistorySize     = 256
+
+	// Time allowed to write a message to the peer.
+	// メッセージを書き込みきれるまでの制限時間
+	defaultWriteWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	defaultPongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	defaultPingPeriod = (defaultPongWait * 9) / 10
+)
+
+// ServerConfig holds the knobs that used to be hard-coded constants and the
+// zero-value Upgrader, so operators can tune buffer sizes, enable per-message
+// compression, and restrict allowed origins without touching serveWs.
+// ServerConfigは、以前は定数やゼロ値のUpgraderに埋め込まれていた調整項目を
+// まとめたものです。これにより、serveWsを触らずにバッファサイズの変更や
+// メッセージ単位の圧縮の有効化、許可オリジンの制限ができます。
+type ServerConfig struct {
+	// ReadBufferSize and WriteBufferSize size the websocket connection's
+	// I/O buffers. Larger payloads (e.g. once compression is on) benefit
+	// from larger buffers.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableCompression turns on the permessage-deflate extension for
+	// connections accepted with this config. CompressionLevel is forwarded
+	// to conn.SetCompressionLevel when EnableCompression is true; see
+	// compress/flate for the valid range.
+	EnableCompression bool
+	CompressionLevel  int
+
+	// AllowedOrigins is a allow-list of Origin header values permitted to
+	// upgrade. An empty list falls back to same-origin enforcement rather
+	// than accepting every origin; see checkOrigin.
+	// AllowedOriginsは、アップグレードを許可するOriginヘッダーの値一覧です。
+	// 空の場合は全オリジンを許可するのではなく、same-origin検証にフォール
+	// バックします。checkOriginを参照してください。
+	AllowedOrigins []string
+
+	// MaxMessageSize is the maximum size, in bytes, of a message accepted
+	// from a peer.
+	MaxMessageSize int64
+
+	// SendBufferSize is the capacity of each Client's outbound send channel.
+	SendBufferSize int
+
+	// WriteWait, PongWait and PingPeriod are the same timeouts the pumps
+	// always used, now sourced from config instead of package constants.
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+
+	// HistorySize is how many broadcast envelopes the default in-memory
+	// HistoryStore retains for replay on reconnect. 0 disables history.
+	HistorySize int
+
+	// TopicRoles maps a topic name to the role required to receive
+	// broadcasts on it. A topic with no entry carries no role
+	// restriction. The Hub stamps this onto every broadcast envelope's
+	// RequiredRole itself, rather than trusting whatever a client set on
+	// the wire, the same way From is always server-assigned rather than
+	// client-supplied.
+	// TopicRolesは、トピック名からそのトピックの配信に必要なロールへの
+	// マッピングです。エントリのないトピックにはロール制限がありません。
+	// Fromが常にクライアントの自己申告ではなくサーバー側で割り当てられる
+	// のと同様に、HubはワイヤーでクライアントがRequiredRoleに何を指定
+	// していようと信用せず、broadcastされる全Envelopeにこれを自ら刻みます。
+	TopicRoles map[string]string
+}
+
+// DefaultServerConfig returns the settings this server used before it was
+// made configurable: 1024-byte buffers, compression off, same-origin
+// enforcement, and the original timeouts.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadBufferSize:    defaultReadBufferSize,
+		WriteBufferSize:   defaultWriteBufferSize,
+		EnableCompression: false,
+		CompressionLevel:  flate.DefaultCompression,
+		MaxMessageSize:    defaultMaxMessageSize,
+		SendBufferSize:    defaultSendBufferSize,
+		WriteWait:         defaultWriteWait,
+		PongWait:          defaultPongWait,
+		PingPeriod:        defaultPingPeriod,
+		HistorySize:       defaultHistorySize,
+	}
+}
+
+// upgrader builds the websocket.Upgrader this config describes. It returns a
+// pointer since (*websocket.Upgrader).Upgrade has a pointer receiver.
+func (cfg ServerConfig) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		EnableCompression: cfg.EnableCompression,
+		CheckOrigin:       cfg.checkOrigin,
+	}
+}
+
+// checkOrigin implements the allow-list described by AllowedOrigins. With no
+// allow-list configured it falls back to the same same-origin check the
+// zero-value Upgrader performs when CheckOrigin is nil: reject any Origin
+// that doesn't match the request's Host. An accept-all default here would
+// quietly disable that protection and, combined with cookie-based
+// authentication, would let a cross-origin page ride a victim's session
+// cookie into a WebSocket connection.
+// checkOriginは、AllowedOriginsで指定された許可リストを実装します。許可
+// リストが設定されていない場合は、CheckOriginがnilのときのゼロ値の
+// Upgraderと同じsame-origin検証（Originがリクエストのホストと一致しない
+// 限り拒否）にフォールバックします。ここで全許可をデフォルトにすると、
+// その保護を静かに無効化してしまい、Cookieベースの認証と組み合わさると、
+// クロスオリジンのページが被害者のセッションCookieに乗ってWebSocket接続
+// を確立できてしまいます。
+func (cfg ServerConfig) checkOrigin(r *http.Request) bool {
+	if len(cfg.AllowedOrigins) > 0 {
+		origin := r.Header.Get("Origin")
+		for _, allowed := range cfg.AllowedOrigins {
+			if origin == allowed {
+				return true
+			}
+		}
+		return false
+	}
+	return checkSameOrigin(r)
+}
+
+// checkSameOrigin mirrors gorilla/websocket's default CheckOrigin: an absent
+// Origin header (a non-browser client) is allowed, otherwise its host must
+// match the request's Host.
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
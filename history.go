@@ -0,0 +1,85 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "sync"
+
+// HistoryStore records broadcast envelopes so a reconnecting client can
+// replay what it missed. Implementations must be safe for concurrent use,
+// since Hub.run calls Append from its single goroutine while serveWs calls
+// Since from each connection's goroutine. The default memoryHistoryStore
+// keeps a fixed-size ring in memory; a file- or Redis-backed store can
+// implement the same interface without Hub.run needing to change.
+// HistoryStoreは、再接続したクライアントが聞き逃した分を再生できるように、
+// broadcastされたEnvelopeを記録します。Hub.runは単一のゴルーチンから
+// Appendを呼び、serveWsは各接続のゴルーチンからSinceを呼ぶため、実装は
+// 並行利用に対して安全でなければなりません。デフォルトのmemoryHistoryStore
+// は固定サイズのリングをメモリ上に保持しますが、同じインターフェースを
+// 実装すれば、Hub.runを変更せずにファイルやRedisベースのストアに
+// 差し替えられます。
+type HistoryStore interface {
+	// Append records envelope as the next history entry and returns the
+	// seq it was assigned. Seq values are monotonically increasing and
+	// start at 1.
+	Append(envelope Envelope) uint64
+
+	// Since returns every recorded envelope with Seq strictly greater
+	// than since, in the order they were appended. Envelopes the store
+	// has since evicted (e.g. a ring buffer past capacity) are simply
+	// omitted.
+	Since(since uint64) []Envelope
+}
+
+// memoryHistoryStore is the default HistoryStore: a fixed-size in-memory
+// ring buffer. Once full, appending drops the oldest recorded envelope.
+// memoryHistoryStoreは、デフォルトのHistoryStoreです。固定サイズのリング
+// バッファをメモリ上に保持し、満杯になったら最も古いEnvelopeから
+// 捨てられます。
+type memoryHistoryStore struct {
+	mu      sync.Mutex
+	size    int
+	nextSeq uint64
+	ring    []Envelope
+}
+
+// newMemoryHistoryStore creates a memoryHistoryStore holding up to size
+// envelopes. A size of 0 keeps no history; Since always returns an empty
+// slice.
+func newMemoryHistoryStore(size int) *memoryHistoryStore {
+	return &memoryHistoryStore{size: size}
+}
+
+// Append implements HistoryStore.
+func (s *memoryHistoryStore) Append(envelope Envelope) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextSeq++
+	envelope.Seq = s.nextSeq
+	if s.size <= 0 {
+		return envelope.Seq
+	}
+	if len(s.ring) < s.size {
+		s.ring = append(s.ring, envelope)
+	} else {
+		copy(s.ring, s.ring[1:])
+		s.ring[len(s.ring)-1] = envelope
+	}
+	return envelope.Seq
+}
+
+// Since implements HistoryStore.
+func (s *memoryHistoryStore) Since(since uint64) []Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Envelope, 0, len(s.ring))
+	for _, envelope := range s.ring {
+		if envelope.Seq > since {
+			out = append(out, envelope)
+		}
+	}
+	return out
+}
@@ -4,33 +4,139 @@
 
 package main
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
-// ハブはアクティブなクライアントのセットを維持し、クライアントにメッセージをブロードキャストします。
+import "github.com/google/uuid"
+
+// Envelope wraps a chat payload with routing information. A zero-value To
+// means "broadcast to everyone"; any other value routes the payload to the
+// single client registered under that id. A non-empty Topic restricts a
+// broadcast to that topic's subscribers instead of every client.
+// Envelopeは、チャットのペイロードに配送先情報を付与したものです。Toがゼロ値
+// の場合は全員にブロードキャストされ、それ以外の場合はそのidで登録されている
+// クライアント1人だけに配送されます。Topicが指定されていれば、ブロードキャスト
+// は全員ではなくそのトピックの購読者だけに配送されます。
+type Envelope struct {
+	To      uuid.UUID `json:"to,omitempty"`
+	From    uuid.UUID `json:"from,omitempty"`
+	Topic   string    `json:"topic,omitempty"`
+	Payload []byte    `json:"payload"`
+
+	// RequiredRole, if set, restricts a broadcast to clients whose
+	// authenticated Identity carries that role. Hub.run always overwrites
+	// this from ServerConfig.TopicRoles before recording or delivering the
+	// envelope, the same way From is server-assigned, so a client can't
+	// forge or strip its own role gate by setting the field on the wire.
+	// RequiredRoleを指定すると、そのロールを持つ認証済みIdentityの
+	// クライアントにだけブロードキャストされます。Fromがサーバー側で
+	// 割り当てられるのと同様に、Hub.runはEnvelopeの記録・配送前に必ず
+	// これをServerConfig.TopicRolesから上書きするため、クライアントが
+	// ワイヤー上でフィールドを指定しても自分のロールゲートを偽装・解除
+	// することはできません。
+	RequiredRole string `json:"requiredRole,omitempty"`
+
+	// Seq is the position this envelope was recorded at in the Hub's
+	// history, assigned when a broadcast is accepted. Clients can persist
+	// the highest Seq they've seen and resume from it after a reconnect.
+	// Seqは、このEnvelopeがHubの履歴に記録された位置で、broadcastが
+	// 受理された時点で割り振られます。クライアントは見た中で一番大きい
+	// Seqを保存しておけば、再接続後にそこから再開できます。
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// subscription pairs a client with a topic for the subscribe/unsubscribe
+// channels below.
+// subscriptionは、subscribe/unsubscribeチャネルでやり取りする、
+// クライアントとトピックの組です。
+type subscription struct {
+	client *Client
+	topic  string
+}
+
+// Hub maintains the set of active clients and routes envelopes between the
+// clients, either by broadcasting to everyone, by broadcasting to a topic's
+// subscribers, or by direct delivery to a single recipient.
+// ハブはアクティブなクライアントのセットを維持し、クライアント同士でEnvelope
+// をやり取りします。宛先なしなら全員に、トピック指定ならその購読者だけに
+// ブロードキャストし、宛先があればその1人にだけ配送します。
 type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
+	// Registered clients, keyed by their connection id so a direct message
+	// can be routed without scanning every client.
+	// 接続idをキーにした登録済みクライアント一覧。direct配送の際に
+	// 全クライアントを舐めずに宛先を引けるようにするため。
+	clients map[uuid.UUID]*Client
+
+	// Reverse index of topic name to its subscribed clients, so a topic
+	// broadcast only fans out to clients that actually asked for it.
+	// トピック名から、それを購読しているクライアント一覧への逆引きインデックス。
+	// これがあるおかげで、トピック宛のブロードキャストは購読者だけに届く。
+	topics map[string]map[*Client]bool
+
+	// Inbound envelopes to fan out. A non-empty Topic restricts delivery to
+	// that topic's subscribers; otherwise every client receives it.
+	broadcast chan Envelope
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Inbound envelopes addressed to a single client.
+	direct chan Envelope
+
+	// Subscribe/unsubscribe requests from the clients.
+	subscribe   chan subscription
+	unsubscribe chan subscription
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// history records every envelope accepted on broadcast so a
+	// reconnecting client can replay what it missed. Swappable via
+	// newHub so the in-memory ring can be backed by a file or Redis
+	// instead.
+	// historyは、broadcastで受理された全Envelopeを記録し、再接続した
+	// クライアントが聞き逃した分を再生できるようにします。newHubで
+	// 差し替え可能なので、インメモリのリングをファイルやRedisに
+	// 置き換えられます。
+	history HistoryStore
+
+	// topicRoles mirrors ServerConfig.TopicRoles. run stamps the
+	// configured role onto every broadcast envelope's RequiredRole itself,
+	// discarding whatever a client set, so role-gating can't be bypassed
+	// by a client simply omitting or forging the field.
+	// topicRolesは、ServerConfig.TopicRolesをそのまま写したものです。runは、
+	// broadcastされる全Envelopeのクライアントが指定したRequiredRoleを
+	// 捨て、設定されたロールを自ら刻みます。これにより、クライアントが
+	// フィールドを省略・偽装するだけでロール制限を回避できなくなります。
+	topicRoles map[string]string
+}
+
+// NewHub creates a Hub whose broadcast history is kept in the default
+// in-memory store, sized per config.HistorySize, and whose topic role
+// restrictions come from config.TopicRoles.
+func NewHub(config ServerConfig) *Hub {
+	hub := newHub(newMemoryHistoryStore(config.HistorySize))
+	hub.topicRoles = config.TopicRoles
+	return hub
 }
 
-func newHub() *Hub {
+// newHub creates a Hub whose broadcast history is recorded in store.
+func newHub(store HistoryStore) *Hub {
 	return &Hub{
-		// ここにメッセージぶっこめば、全員にメッセージが送信される
-		broadcast: make(chan []byte),
+		// ここにEnvelopeをぶっこめば、全員（またはトピックの購読者）に送信される
+		broadcast: make(chan Envelope),
+		// ここにEnvelopeをぶっこめば、Toで指定した1人にだけ送信される
+		direct: make(chan Envelope),
 		// ここにクライアントをぶち込めば、それを登録する
 		register: make(chan *Client),
 		// ここにクライアントをぶち込めば、それを削除する
 		unregister: make(chan *Client),
-		// 登録されている、クライアント一覧
-		clients: make(map[*Client]bool),
+		// ここに{client, topic}をぶち込めば、購読/購読解除される
+		subscribe:   make(chan subscription),
+		unsubscribe: make(chan subscription),
+		// 登録されている、クライアント一覧（idで引ける）
+		clients: make(map[uuid.UUID]*Client),
+		// トピックごとの購読者一覧
+		topics: make(map[string]map[*Client]bool),
+		// 再生用の配信履歴
+		history: store,
 	}
 }
 
@@ -38,24 +144,132 @@ func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.clients[client.id] = client
 		// そのクライアントのコネクション情報を削除し、sendチャネルを切断
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			h.dropClient(client)
+		case sub := <-h.subscribe:
+			// 既にdropClientされたクライアント（sendはclose済み）は購読させない
+			if _, ok := h.clients[sub.client.id]; !ok {
+				continue
+			}
+			clients, ok := h.topics[sub.topic]
+			if !ok {
+				clients = make(map[*Client]bool)
+				h.topics[sub.topic] = clients
+			}
+			clients[sub.client] = true
+		case sub := <-h.unsubscribe:
+			h.removeSubscriber(sub.topic, sub.client)
+		case envelope := <-h.broadcast:
+			// RequiredRoleはクライアントの自己申告を信用せず、トピックの
+			// 設定から自ら刻み直す（Fromと同じ扱い）
+			envelope.RequiredRole = h.topicRoles[envelope.Topic]
+			// 履歴に記録し、割り振られたseqをEnvelopeに刻む
+			envelope.Seq = h.history.Append(envelope)
+			// トピック指定があれば、その購読者だけに配送する
+			if envelope.Topic != "" {
+				for client := range h.topics[envelope.Topic] {
+					if envelope.RequiredRole != "" && !client.identity.hasRole(envelope.RequiredRole) {
+						continue
+					}
+					select {
+					case client.send <- envelope:
+					default:
+						h.dropClient(client)
+					}
+				}
+				continue
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
+			for _, client := range h.clients {
+				if envelope.RequiredRole != "" && !client.identity.hasRole(envelope.RequiredRole) {
+					continue
+				}
 				select {
 				// ここでメッセージ送れんかったら、速やかにコネクションを切断
 				// 送れたら切断せんけど
-				case client.send <- message:
+				case client.send <- envelope:
 				default:
-					close(client.send)
-					delete(h.clients, client)
+					h.dropClient(client)
 				}
 			}
+		case envelope := <-h.direct:
+			// 宛先が見つからない場合は、黙って捨てる（相手はもう切断済みかも）
+			client, ok := h.clients[envelope.To]
+			if !ok {
+				continue
+			}
+			select {
+			case client.send <- envelope:
+			default:
+				h.dropClient(client)
+			}
 		}
 	}
 }
+
+// dropClient removes client from the hub entirely: the clients index, every
+// topic it was subscribed to, and closes its send channel. It's the single
+// place that does this so a slow-consumer drop during any broadcast path
+// can't leave a client's closed channel sitting in h.topics, which would
+// panic the next topic broadcast with "send on closed channel". Safe to
+// call more than once for the same client.
+// dropClientは、clientをHubから完全に取り除きます：clientsインデックス、
+// 購読していた全トピック、そしてsendチャネルのclose。どのbroadcast経路の
+// 低速コンシューマ切断でも、ここ一箇所を通すことで、closeされたチャネルが
+// h.topicsに残って次のトピックブロードキャストで
+// 「send on closed channel」をpanicさせる事態を防ぎます。同じclientに
+// 対して複数回呼んでも安全です。
+func (h *Hub) dropClient(client *Client) {
+	if _, ok := h.clients[client.id]; !ok {
+		return
+	}
+	delete(h.clients, client.id)
+	close(client.send)
+	for _, topic := range client.topicSnapshot() {
+		h.removeSubscriber(topic, client)
+	}
+}
+
+// replaySince returns the broadcast envelopes recorded after since that
+// client would actually have been delivered live: untargeted (no Topic)
+// envelopes, plus ones for any topic in topics, each still subject to the
+// same RequiredRole check Hub.run applies. serveWs uses it to catch a
+// reconnecting client up before normal delivery resumes, without leaking
+// history for topics or roles the client can't receive live.
+// replaySinceは、clientが実際にライブ配信で受け取れたはずのEnvelopeだけを、
+// sinceより後の分から返します：宛先Topicなしのものと、topicsに含まれる
+// トピックのもので、どちらもHub.runと同じRequiredRoleチェックを通します。
+// serveWsは、再接続したクライアントを通常配信の再開前に追いつかせる際、
+// ライブでは受け取れないはずのトピックやロールの履歴を漏らさないために
+// これを使います。
+func (h *Hub) replaySince(client *Client, since uint64, topics map[string]struct{}) []Envelope {
+	var out []Envelope
+	for _, envelope := range h.history.Since(since) {
+		if envelope.RequiredRole != "" && !client.identity.hasRole(envelope.RequiredRole) {
+			continue
+		}
+		if envelope.Topic != "" {
+			if _, ok := topics[envelope.Topic]; !ok {
+				continue
+			}
+		}
+		out = append(out, envelope)
+	}
+	return out
+}
+
+// removeSubscriber drops client from topic's subscriber set, clearing the
+// topic entirely once its last subscriber leaves.
+// removeSubscriberは、clientをtopicの購読者集合から外します。
+// 最後の購読者がいなくなったら、トピックのエントリごと削除します。
+func (h *Hub) removeSubscriber(topic string, client *Client) {
+	clients, ok := h.topics[topic]
+	if !ok {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.topics, topic)
+	}
+}